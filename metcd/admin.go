@@ -0,0 +1,246 @@
+package metcd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/coreos/etcd/raft/raftpb"
+
+	"github.com/weaveworks/mesh"
+)
+
+// AdminServer is the metcd analogue of Quorum's raft.addPeer/raft.removePeer
+// JSON-RPC calls: it lets an operator reshape Raft cluster membership at
+// runtime over gRPC, rather than relying solely on mesh peer arrival and
+// departure events translated by newConfigurator.
+type AdminServer interface {
+	AddPeer(context.Context, *AddPeerRequest) (*AddPeerResponse, error)
+	RemovePeer(context.Context, *RemovePeerRequest) (*RemovePeerResponse, error)
+	ListPeers(context.Context, *ListPeersRequest) (*ListPeersResponse, error)
+	Promote(context.Context, *PromoteRequest) (*PromoteResponse, error)
+}
+
+// AddPeerRequest proposes adding a peer as a full voting member.
+type AddPeerRequest struct {
+	PeerName mesh.PeerName
+	PeerUID  mesh.PeerUID
+}
+
+// AddPeerResponse is returned once the ConfChange has committed.
+type AddPeerResponse struct{}
+
+// RemovePeerRequest proposes removing a peer from the cluster.
+type RemovePeerRequest struct {
+	PeerName mesh.PeerName
+}
+
+// RemovePeerResponse is returned once the ConfChange has committed.
+type RemovePeerResponse struct{}
+
+// ListPeersRequest has no fields; it just asks for the current member set.
+type ListPeersRequest struct{}
+
+// ListPeersResponse describes the current Raft member set.
+type ListPeersResponse struct {
+	Peers []Peer
+}
+
+// PromoteRequest asks that an existing learner be converted to a full
+// voting member, e.g. once it has caught up on snapshots and log entries.
+type PromoteRequest struct {
+	PeerUID mesh.PeerUID
+}
+
+// PromoteResponse is returned once the promotion has committed.
+type PromoteResponse struct{}
+
+// Peer identifies a single Raft cluster member.
+type Peer struct {
+	Name    mesh.PeerName
+	UID     mesh.PeerUID
+	Learner bool
+}
+
+// adminServer implements AdminServer by pushing ConfChange proposals into
+// confchangec and waiting for the corresponding entry to come back out of
+// confentryc as committed: the same path mesh-driven membership changes
+// already take through newConfigurator.
+type adminServer struct {
+	confchangec chan<- raftpb.ConfChange
+	confentryc  <-chan raftpb.Entry
+	logger      Logger
+
+	nextID uint64
+
+	mtx     sync.Mutex
+	peers   map[uint64]Peer
+	waiters map[uint64]chan struct{}
+}
+
+// newAdminServer creates an adminServer and starts the goroutine that
+// applies committed conf change entries to its view of the member set.
+func newAdminServer(confchangec chan<- raftpb.ConfChange, confentryc <-chan raftpb.Entry, logger Logger) *adminServer {
+	a := &adminServer{
+		confchangec: confchangec,
+		confentryc:  confentryc,
+		logger:      logger,
+		peers:       map[uint64]Peer{},
+		waiters:     map[uint64]chan struct{}{},
+	}
+	go a.loop()
+	return a
+}
+
+func (a *adminServer) loop() {
+	for entry := range a.confentryc {
+		if entry.Type != raftpb.EntryConfChange {
+			continue
+		}
+		var cc raftpb.ConfChange
+		if err := cc.Unmarshal(entry.Data); err != nil {
+			a.logger.Warn("admin: bad conf change entry", "err", err)
+			continue
+		}
+		a.apply(cc)
+	}
+}
+
+// apply updates the known member set for a committed ConfChange, and wakes
+// the specific propose call that was waiting on cc.ID to commit. Waiters are
+// keyed by cc.ID rather than cc.NodeID, since AddPeer, Promote, and a
+// re-AddPeer can all propose a ConfChangeAddNode for the same NodeID
+// concurrently; keying by NodeID would let one call's commit wake another's
+// unrelated proposal.
+func (a *adminServer) apply(cc raftpb.ConfChange) {
+	a.mtx.Lock()
+	switch cc.Type {
+	case raftpb.ConfChangeAddLearnerNode:
+		name, err := mesh.PeerNameFromString(string(cc.Context))
+		if err != nil {
+			a.logger.Warn("admin: bad peer name in conf change context", "err", err)
+		} else {
+			a.peers[cc.NodeID] = Peer{Name: name, UID: mesh.PeerUID(cc.NodeID), Learner: true}
+		}
+	case raftpb.ConfChangeAddNode:
+		// A bare AddNode for a NodeID we already know as a learner is a
+		// promotion to full voter; otherwise it's a brand new voter.
+		p := a.peers[cc.NodeID]
+		p.UID = mesh.PeerUID(cc.NodeID)
+		p.Learner = false
+		if p.Name == 0 {
+			name, err := mesh.PeerNameFromString(string(cc.Context))
+			if err != nil {
+				a.logger.Warn("admin: bad peer name in conf change context", "err", err)
+			} else {
+				p.Name = name
+			}
+		}
+		a.peers[cc.NodeID] = p
+	case raftpb.ConfChangeRemoveNode:
+		delete(a.peers, cc.NodeID)
+	}
+	wait := a.waiters[cc.ID]
+	delete(a.waiters, cc.ID)
+	a.mtx.Unlock()
+
+	if wait != nil {
+		close(wait)
+	}
+}
+
+func (a *adminServer) AddPeer(ctx context.Context, req *AddPeerRequest) (*AddPeerResponse, error) {
+	cc := raftpb.ConfChange{
+		Type:    raftpb.ConfChangeAddNode,
+		NodeID:  uint64(req.PeerUID),
+		Context: []byte(req.PeerName.String()),
+	}
+	if err := a.propose(ctx, cc); err != nil {
+		return nil, err
+	}
+	return &AddPeerResponse{}, nil
+}
+
+func (a *adminServer) RemovePeer(ctx context.Context, req *RemovePeerRequest) (*RemovePeerResponse, error) {
+	nodeID, ok := a.lookup(req.PeerName)
+	if !ok {
+		return nil, fmt.Errorf("peer %s not found", req.PeerName)
+	}
+	cc := raftpb.ConfChange{
+		Type:   raftpb.ConfChangeRemoveNode,
+		NodeID: nodeID,
+	}
+	if err := a.propose(ctx, cc); err != nil {
+		return nil, err
+	}
+	return &RemovePeerResponse{}, nil
+}
+
+func (a *adminServer) Promote(ctx context.Context, req *PromoteRequest) (*PromoteResponse, error) {
+	a.mtx.Lock()
+	p, ok := a.peers[uint64(req.PeerUID)]
+	a.mtx.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("peer %x not found", uint64(req.PeerUID))
+	}
+	if !p.Learner {
+		return nil, fmt.Errorf("peer %x is already a voter", uint64(req.PeerUID))
+	}
+
+	cc := raftpb.ConfChange{
+		Type:    raftpb.ConfChangeAddNode,
+		NodeID:  uint64(req.PeerUID),
+		Context: []byte(p.Name.String()),
+	}
+	if err := a.propose(ctx, cc); err != nil {
+		return nil, err
+	}
+	return &PromoteResponse{}, nil
+}
+
+func (a *adminServer) ListPeers(ctx context.Context, req *ListPeersRequest) (*ListPeersResponse, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	resp := &ListPeersResponse{}
+	for _, p := range a.peers {
+		resp.Peers = append(resp.Peers, p)
+	}
+	return resp, nil
+}
+
+func (a *adminServer) lookup(name mesh.PeerName) (uint64, bool) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for id, p := range a.peers {
+		if p.Name == name {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// propose assigns cc a unique ID, pushes it into confchangec, and blocks
+// until loop has observed and applied the matching committed entry, or ctx
+// is done.
+func (a *adminServer) propose(ctx context.Context, cc raftpb.ConfChange) error {
+	cc.ID = atomic.AddUint64(&a.nextID, 1)
+
+	wait := make(chan struct{})
+	a.mtx.Lock()
+	a.waiters[cc.ID] = wait
+	a.mtx.Unlock()
+
+	select {
+	case a.confchangec <- cc:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-wait:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
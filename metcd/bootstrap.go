@@ -0,0 +1,324 @@
+package metcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+	"github.com/weaveworks/mesh/meshconn"
+)
+
+// bootstrapChannel is the name of the mesh gossip channel peers use to agree
+// on how to bootstrap their Raft cluster, before any Raft traffic exists.
+const bootstrapChannel = "metcd-bootstrap"
+
+// peerIdentity is the minimal information needed to construct a
+// meshconn.MeshAddr for a peer.
+type peerIdentity struct {
+	Name mesh.PeerName
+	UID  mesh.PeerUID
+}
+
+func (p peerIdentity) Addr() net.Addr {
+	return meshconn.MeshAddr{PeerName: p.Name, PeerUID: p.UID}
+}
+
+// String uniquely identifies a peer as a string, so it can be used as a
+// JSON object key: json.Marshal refuses to encode a map keyed by a struct.
+func (p peerIdentity) String() string {
+	return fmt.Sprintf("%s/%x", p.Name.String(), uint64(p.UID))
+}
+
+// bootstrapState is what each peer broadcasts while the cluster is deciding
+// how to bootstrap itself. Peers merge these to reach a shared view of who
+// is visible to whom, without relying on timing.
+type bootstrapState struct {
+	Self       peerIdentity
+	Clock      int64
+	Generation uint64
+	Visible    []peerIdentity // peers Self can currently see, including itself
+}
+
+func (s bootstrapState) Encode() [][]byte {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return [][]byte{buf}
+}
+
+func (s bootstrapState) Merge(other mesh.GossipData) mesh.GossipData {
+	o := other.(bootstrapSet)
+	merged := bootstrapSet{s.Self.String(): s}
+	for k, v := range o {
+		if existing, ok := merged[k]; !ok || v.Generation > existing.Generation {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// bootstrapSet is the GossipData actually carried around: the latest known
+// bootstrapState from every peer that has spoken up so far, keyed by
+// peerIdentity.String() since encoding/json cannot marshal a map keyed by a
+// struct.
+type bootstrapSet map[string]bootstrapState
+
+func (s bootstrapSet) Encode() [][]byte {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return [][]byte{buf}
+}
+
+func (s bootstrapSet) Merge(other mesh.GossipData) mesh.GossipData {
+	o := other.(bootstrapSet)
+	merged := make(bootstrapSet, len(s)+len(o))
+	for k, v := range s {
+		merged[k] = v
+	}
+	for k, v := range o {
+		if existing, ok := merged[k]; !ok || v.Generation > existing.Generation {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+func decodeBootstrapSet(update []byte) (bootstrapSet, error) {
+	var s bootstrapSet
+	if err := json.Unmarshal(update, &s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Bootstrap coordinates, via gossip, how a set of mesh peers should form
+// their initial Raft cluster membership. Each peer broadcasts the set of
+// peers it can currently see; once a peer has observed at least
+// minPeerCount mutually-visible peers, all peers deterministically agree
+// that the one with the lowest PeerName among the visible set is the
+// "creator", and the rest join the member set the creator proposed. This
+// replaces polling router.Peers.Descriptions() on a timer, which suffers
+// from timing failures and has no notion of quorum.
+type Bootstrap struct {
+	router       *mesh.Router
+	self         peerIdentity
+	minPeerCount int
+	logger       Logger
+
+	gossip mesh.Gossip
+
+	mtx        sync.Mutex
+	generation uint64
+	set        bootstrapSet
+
+	resultc chan bootstrapResult
+}
+
+type bootstrapResult struct {
+	members []net.Addr
+	creator bool
+	err     error
+}
+
+// NewBootstrap creates a Bootstrap and registers it on a dedicated mesh
+// gossip channel. Call WaitForQuorum to block until the cluster has agreed
+// on its initial membership.
+func NewBootstrap(router *mesh.Router, self peerIdentity, minPeerCount int, logger Logger) *Bootstrap {
+	b := &Bootstrap{
+		router:       router,
+		self:         self,
+		minPeerCount: minPeerCount,
+		logger:       logger,
+		set:          bootstrapSet{},
+		resultc:      make(chan bootstrapResult, 1),
+	}
+	b.gossip = router.NewGossip(bootstrapChannel, b)
+	return b
+}
+
+// WaitForQuorum blocks until enough peers are mutually visible to agree on
+// an initial member set, or ctx is canceled. It returns whether this peer is
+// the one that should create the cluster; if so, members is the agreed
+// initial member set to bootstrap with, otherwise members is empty and this
+// peer should join the cluster the creator bootstraps.
+func (b *Bootstrap) WaitForQuorum(ctx context.Context) ([]net.Addr, bool, error) {
+	b.announce()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case r := <-b.resultc:
+			return r.members, r.creator, r.err
+		case <-ticker.C:
+			b.announce()
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// announce publishes our current view of visible peers and re-checks for
+// quorum locally, in case gossip from other peers already got us there.
+func (b *Bootstrap) announce() {
+	var visible []peerIdentity
+	for _, desc := range b.router.Peers.Descriptions() {
+		visible = append(visible, peerIdentity{Name: desc.Name, UID: desc.UID})
+	}
+
+	b.mtx.Lock()
+	b.generation++
+	state := bootstrapState{
+		Self:       b.self,
+		Clock:      time.Now().UnixNano(),
+		Generation: b.generation,
+		Visible:    visible,
+	}
+	b.set[b.self.String()] = state
+	b.checkQuorum()
+	b.mtx.Unlock()
+
+	b.gossip.GossipBroadcast(bootstrapSet{b.self.String(): state})
+}
+
+// checkQuorum must be called with b.mtx held. It computes a clique of
+// mutually-visible peers over the full,
+// gossiped b.set — not just b.self's own direct view — so that any two
+// peers who have converged on the same b.set compute the identical clique,
+// and therefore agree on the same creator. Using only one peer's direct
+// Visible list (as an earlier version of this did) let two peers each
+// latch onto a different minPeerCount-sized subset as soon as their own
+// local view happened to reach quorum, electing two different creators and
+// splitting the cluster in two; requiring every pair within the clique to
+// mutually list each other closes that gap. If the resulting clique has
+// >= minPeerCount members, it decides the outcome and delivers it to
+// resultc.
+func (b *Bootstrap) checkQuorum() {
+	if _, ok := b.set[b.self.String()]; !ok {
+		return
+	}
+
+	// Start from every peer gossip has told us about, including ones we
+	// haven't directly seen ourselves, and prune until only a clique of
+	// mutual visibility remains: repeatedly drop any peer that doesn't see
+	// every other remaining peer, until nothing more can be dropped.
+	clique := map[peerIdentity]bool{}
+	for _, state := range b.set {
+		clique[state.Self] = true
+	}
+
+	for pruned := true; pruned; {
+		pruned = false
+		// Visit candidates in a fixed order, so which peer gets dropped
+		// first doesn't depend on map iteration order.
+		candidates := make([]peerIdentity, 0, len(clique))
+		for p := range clique {
+			candidates = append(candidates, p)
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].String() < candidates[j].String() })
+		for _, p := range candidates {
+			state, ok := b.set[p.String()]
+			if !ok {
+				delete(clique, p)
+				pruned = true
+				break
+			}
+			visible := map[peerIdentity]bool{}
+			for _, q := range state.Visible {
+				visible[q] = true
+			}
+			for q := range clique {
+				if q != p && !visible[q] {
+					delete(clique, p)
+					pruned = true
+					break
+				}
+			}
+			if pruned {
+				break
+			}
+		}
+	}
+
+	if !clique[b.self] || len(clique) < b.minPeerCount {
+		return
+	}
+
+	var peers []peerIdentity
+	for p := range clique {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+
+	// By convention, a populated member list means "bootstrap/create",
+	// and an empty one means "join": the elected creator gets the agreed
+	// set to seed the cluster with, while everyone else joins it with no
+	// initial members of their own.
+	creator := peers[0] == b.self
+	var members []net.Addr
+	if creator {
+		for _, p := range peers {
+			members = append(members, p.Addr())
+		}
+	}
+
+	select {
+	case b.resultc <- bootstrapResult{members: members, creator: creator}:
+		b.logger.Info("bootstrap: quorum reached", "peers", len(peers), "creator", creator)
+	default:
+		// Already delivered.
+	}
+}
+
+// OnGossipUnicast implements mesh.Gossiper.
+func (b *Bootstrap) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	return b.merge(msg)
+}
+
+// OnGossipBroadcast implements mesh.Gossiper.
+func (b *Bootstrap) OnGossipBroadcast(sender mesh.PeerName, update []byte) (mesh.GossipData, error) {
+	delta, err := b.mergeDelta(update)
+	if err != nil {
+		return nil, err
+	}
+	return delta, nil
+}
+
+// OnGossip implements mesh.Gossiper.
+func (b *Bootstrap) OnGossip(update []byte) (mesh.GossipData, error) {
+	return b.mergeDelta(update)
+}
+
+func (b *Bootstrap) merge(update []byte) error {
+	_, err := b.mergeDelta(update)
+	return err
+}
+
+func (b *Bootstrap) mergeDelta(update []byte) (mesh.GossipData, error) {
+	incoming, err := decodeBootstrapSet(update)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	delta := bootstrapSet{}
+	for k, v := range incoming {
+		if existing, ok := b.set[k]; !ok || v.Generation > existing.Generation {
+			b.set[k] = v
+			delta[k] = v
+		}
+	}
+	if len(delta) > 0 {
+		b.checkQuorum()
+	}
+	return delta, nil
+}
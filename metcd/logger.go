@@ -0,0 +1,81 @@
+package metcd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger is a structured, contextual logger. With returns a Logger that
+// prepends kv (alternating key, value pairs) to every message it logs,
+// so callers can build up fields like "peer", "raft_id", "term", "index",
+// "to", or "msg_type" as they pass a Logger down through grpcManager,
+// newMembership, newConfigurator, the transport, newEtcdStore, and newCtrl,
+// instead of threading a bare *log.Logger and formatting ad-hoc strings
+// like "detected %d peers; waiting...".
+type Logger interface {
+	With(kv ...interface{}) Logger
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+// stdLogger adapts a *log.Logger to the Logger interface, for backward
+// compatibility with callers that already have one. It has no notion of
+// level filtering: every call is written through to the underlying logger.
+type stdLogger struct {
+	l      *log.Logger
+	fields []interface{}
+}
+
+// NewStdLogger wraps l as a Logger. Pass this to NewServer/NewDefaultServer
+// wherever a plain *log.Logger used to be accepted directly.
+func NewStdLogger(l *log.Logger) Logger {
+	return &stdLogger{l: l}
+}
+
+func (s *stdLogger) With(kv ...interface{}) Logger {
+	return &stdLogger{l: s.l, fields: append(append([]interface{}{}, s.fields...), kv...)}
+}
+
+func (s *stdLogger) Debug(msg string, kv ...interface{}) { s.log("debug", msg, kv) }
+func (s *stdLogger) Info(msg string, kv ...interface{})  { s.log("info", msg, kv) }
+func (s *stdLogger) Warn(msg string, kv ...interface{})  { s.log("warn", msg, kv) }
+func (s *stdLogger) Error(msg string, kv ...interface{}) { s.log("error", msg, kv) }
+
+func (s *stdLogger) log(level, msg string, kv []interface{}) {
+	all := append(append([]interface{}{}, s.fields...), kv...)
+	s.l.Print(formatKV(level, msg, all))
+}
+
+// AsStdLogger adapts a Logger back to a *log.Logger, for passing to APIs
+// like mesh.NewRouter and meshconn.NewPeer that predate this package's
+// structured Logger interface.
+func AsStdLogger(logger Logger) *log.Logger {
+	return log.New(stdLoggerWriter{logger}, "", 0)
+}
+
+type stdLoggerWriter struct{ logger Logger }
+
+func (w stdLoggerWriter) Write(p []byte) (int, error) {
+	w.logger.Info(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// formatKV renders level, msg, and an alternating key/value slice as
+// "level=info msg=\"detected peers\" peer=foo count=3". An odd trailing key
+// with no value is rendered with value "MISSING".
+func formatKV(level, msg string, kv []interface{}) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "level=%s msg=%q", level, msg)
+	for i := 0; i < len(kv); i += 2 {
+		key := kv[i]
+		value := interface{}("MISSING")
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		fmt.Fprintf(&b, " %v=%v", key, value)
+	}
+	return b.String()
+}
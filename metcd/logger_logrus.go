@@ -0,0 +1,49 @@
+package metcd
+
+import "github.com/Sirupsen/logrus"
+
+// logrusLogger adapts a logrus.FieldLogger to the Logger interface.
+type logrusLogger struct {
+	l logrus.FieldLogger
+}
+
+// NewLogrusLogger wraps l as a Logger.
+func NewLogrusLogger(l logrus.FieldLogger) Logger {
+	return &logrusLogger{l: l}
+}
+
+func (r *logrusLogger) With(kv ...interface{}) Logger {
+	return &logrusLogger{l: r.l.WithFields(fieldsFrom(kv))}
+}
+
+func (r *logrusLogger) Debug(msg string, kv ...interface{}) { r.with(kv).Debug(msg) }
+func (r *logrusLogger) Info(msg string, kv ...interface{})  { r.with(kv).Info(msg) }
+func (r *logrusLogger) Warn(msg string, kv ...interface{})  { r.with(kv).Warn(msg) }
+func (r *logrusLogger) Error(msg string, kv ...interface{}) { r.with(kv).Error(msg) }
+
+func (r *logrusLogger) with(kv []interface{}) logrus.FieldLogger {
+	if len(kv) == 0 {
+		return r.l
+	}
+	return r.l.WithFields(fieldsFrom(kv))
+}
+
+func fieldsFrom(kv []interface{}) logrus.Fields {
+	fields := make(logrus.Fields, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		key := fmtKey(kv[i])
+		if i+1 < len(kv) {
+			fields[key] = kv[i+1]
+		} else {
+			fields[key] = "MISSING"
+		}
+	}
+	return fields
+}
+
+func fmtKey(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return "key"
+}
@@ -0,0 +1,35 @@
+package metcd
+
+import "github.com/uber-go/zap"
+
+// zapLogger adapts a zap.Logger to the Logger interface.
+type zapLogger struct {
+	l zap.Logger
+}
+
+// NewZapLogger wraps l as a Logger.
+func NewZapLogger(l zap.Logger) Logger {
+	return &zapLogger{l: l}
+}
+
+func (z *zapLogger) With(kv ...interface{}) Logger {
+	return &zapLogger{l: z.l.With(fieldsFromZap(kv)...)}
+}
+
+func (z *zapLogger) Debug(msg string, kv ...interface{}) { z.l.Debug(msg, fieldsFromZap(kv)...) }
+func (z *zapLogger) Info(msg string, kv ...interface{})  { z.l.Info(msg, fieldsFromZap(kv)...) }
+func (z *zapLogger) Warn(msg string, kv ...interface{})  { z.l.Warn(msg, fieldsFromZap(kv)...) }
+func (z *zapLogger) Error(msg string, kv ...interface{}) { z.l.Error(msg, fieldsFromZap(kv)...) }
+
+func fieldsFromZap(kv []interface{}) []zap.Field {
+	fields := make([]zap.Field, 0, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		key := fmtKey(kv[i])
+		var value interface{} = "MISSING"
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		fields = append(fields, zap.Object(key, value))
+	}
+	return fields
+}
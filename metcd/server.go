@@ -1,31 +1,62 @@
 package metcd
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net"
 	"os"
 	"time"
 
 	wackygrpc "github.com/coreos/etcd/Godeps/_workspace/src/google.golang.org/grpc"
+	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
 
 	"github.com/weaveworks/mesh"
 	"github.com/weaveworks/mesh/meshconn"
 )
 
+// Mode controls whether a metcd peer participates in Raft quorum.
+type Mode int
+
+const (
+	// ModeVoter is a normal, voting Raft peer. This is the default.
+	ModeVoter Mode = iota
+	// ModeLearner is a non-voting standby: it receives snapshots and log
+	// entries and serves reads via the etcd V3 API, but does not vote and
+	// cannot be counted towards quorum. Promote an AdminServer client to
+	// turn a learner into a voter without a restart.
+	ModeLearner
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeVoter:
+		return "voter"
+	case ModeLearner:
+		return "learner"
+	default:
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+}
+
 // NewServer returns a gRPC server that implements the etcd V3 API.
 // It uses the passed mesh components to create and manage the Raft transport.
-// For the moment, it blocks until the mesh has minPeerCount peers.
-// (This responsibility should instead be given to the caller.)
+// It blocks until a Bootstrap reaches quorum with minPeerCount peers and the
+// cluster has agreed whether to create or join. mode selects whether this
+// peer joins as a full voter or as a non-voting learner. If storageDir is
+// non-empty, Raft entries, hard state, and periodic snapshots are persisted
+// there, so a restart can recover without re-replicating the whole log; an
+// empty storageDir keeps state in memory only, as before.
 func NewServer(
 	router *mesh.Router,
 	peer *meshconn.Peer,
 	minPeerCount int,
-	logger *log.Logger,
+	mode Mode,
+	storageDir string,
+	logger Logger,
 ) *wackygrpc.Server {
 	c := make(chan *wackygrpc.Server)
-	go grpcManager(router, peer, minPeerCount, logger, c)
+	go grpcManager(router, peer, minPeerCount, mode, storageDir, logger, c)
 	return <-c
 }
 
@@ -33,78 +64,162 @@ func grpcManager(
 	router *mesh.Router,
 	peer *meshconn.Peer,
 	minPeerCount int,
-	logger *log.Logger,
+	mode Mode,
+	storageDir string,
+	logger Logger,
 	out chan<- *wackygrpc.Server,
 ) {
-	// Identify mesh peers to either create or join a cluster.
-	// This algorithm is presently completely insufficient.
-	// It suffers from timing failures, and doesn't understand channels.
-	// TODO(pb): use gossip to agree on better starting conditions
-	var (
-		self   = meshconn.MeshAddr{PeerName: router.Ourself.Peer.Name, PeerUID: router.Ourself.UID}
-		others = []net.Addr{}
-	)
-	for {
-		others = others[:0]
-		for _, desc := range router.Peers.Descriptions() {
-			others = append(others, meshconn.MeshAddr{PeerName: desc.Name, PeerUID: desc.UID})
-		}
-		if len(others) == minPeerCount {
-			logger.Printf("detected %d peers; creating", len(others))
-			break
-		} else if len(others) > minPeerCount {
-			logger.Printf("detected %d peers; joining", len(others))
-			others = others[:0] // empty others slice means join
-			break
-		}
-		logger.Printf("detected %d peers; waiting...", len(others))
-		time.Sleep(time.Second)
+	// Identify mesh peers to either create or join a cluster. We gossip with
+	// our peers until enough of them mutually agree on the initial member
+	// set, rather than polling router.Peers.Descriptions() on a timer.
+	self := peerIdentity{Name: router.Ourself.Peer.Name, UID: router.Ourself.UID}
+	bootstrap := NewBootstrap(router, self, minPeerCount, logger.With("component", "bootstrap"))
+	others, creator, err := bootstrap.WaitForQuorum(context.Background())
+	if err != nil {
+		logger.Error("bootstrap failed", "err", err)
+		return
+	}
+	if creator {
+		logger.Info("bootstrap: creating cluster")
+	} else {
+		logger.Info("bootstrap: joining cluster", "peers", len(others))
 	}
 
 	var (
-		incomingc    = make(chan raftpb.Message)    // from meshconn to ctrl
-		outgoingc    = make(chan raftpb.Message)    // from ctrl to meshconn
-		unreachablec = make(chan uint64, 10000)     // from meshconn to ctrl
-		confchangec  = make(chan raftpb.ConfChange) // from meshconn to ctrl
-		snapshotc    = make(chan raftpb.Snapshot)   // from ctrl to state machine
-		entryc       = make(chan raftpb.Entry)      // from ctrl to state
-		confentryc   = make(chan raftpb.Entry)      // from state to configurator
-		proposalc    = make(chan []byte)            // from state machine to ctrl
-		removedc     = make(chan struct{})          // from ctrl to us
-		shrunkc      = make(chan struct{})          // from membership to us
+		incomingc   = make(chan raftpb.Message)    // from transport to ctrl
+		outgoingc   = make(chan raftpb.Message)    // from ctrl to transport
+		confchangec = make(chan raftpb.ConfChange) // from meshconn to ctrl
+		snapshotc   = make(chan raftpb.Snapshot)   // from ctrl to state machine
+		entryc      = make(chan raftpb.Entry)      // from ctrl to state
+		confentryc  = make(chan raftpb.Entry)      // from state to configurator
+		adminentryc = make(chan raftpb.Entry)      // from state to admin server
+		proposalc   = make(chan []byte)            // from state machine to ctrl
+		removedc    = make(chan struct{})          // from ctrl to us
+		shrunkc     = make(chan struct{})          // from membership to us
 	)
 
-	// Create the thing that watches the cluster membership via the router. It
-	// signals conf changes, and closes shrunkc when the cluster is too small.
-	var (
-		addc = make(chan uint64)
-		remc = make(chan uint64)
-	)
-	m := newMembership(router, membershipSet(router), minPeerCount, addc, remc, shrunkc, logger)
-	defer m.stop()
+	// Voters watch mesh membership and turn arrivals/departures into Raft
+	// ConfChange proposals. A learner doesn't vote, so it has no need for
+	// either of these; instead it proposes a single ConfChangeAddLearnerNode
+	// for itself below, so the committed entry reaches every peer's admin
+	// view and a later Promote can find it. This is a deliberate departure
+	// from the usual rule that a peer shouldn't propose a ConfChange for
+	// itself: without an entry, a.peers in the admin server never learns the
+	// learner exists, and Promote can never find it. The proposal commits
+	// only through a leader of a running cluster. A learner that joins gets
+	// an empty others from Bootstrap, like any joining peer; Bootstrap does
+	// not take mode into account, so a learner with the lowest PeerName is
+	// elected creator like any other peer. The proposal is handed to ctrl
+	// once: the goroutine waits until confchangec accepts it (or removedc
+	// fires) and does not re-send it if it is lost before it commits.
+	if mode == ModeVoter {
+		addc := make(chan uint64)
+		remc := make(chan uint64)
+		m := newMembership(router, membershipSet(router), minPeerCount, addc, remc, shrunkc, logger.With("component", "membership"))
+		defer m.stop()
 
-	// Create the thing that converts mesh membership changes to Raft ConfChange
-	// proposals.
-	c := newConfigurator(addc, remc, confchangec, confentryc, logger)
-	defer c.stop()
+		c := newConfigurator(addc, remc, confchangec, confentryc, logger.With("component", "configurator"))
+		defer c.stop()
+	} else {
+		go func() {
+			cc := raftpb.ConfChange{
+				Type:    raftpb.ConfChangeAddLearnerNode,
+				NodeID:  uint64(self.UID),
+				Context: []byte(self.Name.String()),
+			}
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case confchangec <- cc:
+					return
+				case <-ticker.C:
+					// Keep waiting for confchangec to accept the
+					// proposal.
+				case <-removedc:
+					return
+				}
+			}
+		}()
 
-	// Create a packet transport, wrapping the meshconn.Peer.
-	transport := newPacketTransport(peer, translateVia(router), incomingc, outgoingc, unreachablec, logger)
-	defer transport.stop()
+		// newEtcdStore fans out every committed ConfChange entry to
+		// confentryc unconditionally, but newConfigurator, its only reader,
+		// only runs for voters above. Left unread, the unbuffered
+		// confentryc fills on the very first committed entry (our own
+		// self-proposal is guaranteed to land one), and the store's apply
+		// loop blocks forever, wedging the whole node. Drain and discard
+		// entries ourselves instead.
+		go func() {
+			for range confentryc {
+			}
+		}()
+	}
 
 	// Create the API server. store.stop must go on the defer stack before
 	// ctrl.stop so that the ctrl stops first. Otherwise, ctrl can deadlock
 	// processing the last tick.
-	store := newEtcdStore(proposalc, snapshotc, entryc, confentryc, logger)
+	store := newEtcdStore(proposalc, snapshotc, entryc, confentryc, adminentryc, logger.With("component", "store"))
 	defer store.stop()
 
-	// Create the controller, which drives the Raft node internally.
-	ctrl := newCtrl(self, others, minPeerCount, incomingc, outgoingc, unreachablec, confchangec, snapshotc, entryc, proposalc, removedc, logger)
+	// If storageDir is set, open (or initialize) WAL and snapshot storage
+	// and replay any persisted state into mem before ctrl starts its
+	// raft.Node on top of it. ctrl is responsible for calling storage.Save
+	// with each batch of entries/hard state before applying them, and
+	// storage.MaybeSnapshot as it applies, mirroring the WAL-before-apply
+	// and periodic-snapshot lifecycle storage.go documents.
+	mem := raft.NewMemoryStorage()
+	var storage *Storage
+	if storageDir != "" {
+		var (
+			hs   raftpb.HardState
+			ents []raftpb.Entry
+			err  error
+		)
+		storage, hs, ents, err = openStorage(storageDir, mem, logger.With("component", "storage"))
+		if err != nil {
+			logger.Error("failed to open storage", "err", err)
+			return
+		}
+		defer storage.Close()
+		logger.Info("storage: replayed persisted state", "entries", len(ents), "committed", hs.Commit)
+	}
+
+	// Create the controller, which drives the Raft node internally. In
+	// ModeLearner, ctrl starts the underlying raft.Node with AddLearner
+	// semantics: we receive snapshots and log entries, but have no vote.
+	// ctrl implements the Raft interface the transport needs below. mem is
+	// either freshly replayed from storage above, or empty if storageDir
+	// was empty, in which case storage is nil and ctrl keeps state in
+	// memory only, as before.
+	ctrl := newCtrl(self.Addr(), others, minPeerCount, mode, mem, storage, incomingc, outgoingc, confchangec, snapshotc, entryc, proposalc, removedc, logger.With("component", "ctrl"))
 	defer ctrl.stop()
 
-	// Create the gRPC server, wrapping the store. This is what gets returned to
-	// the user. But, we can shut it down in certain circumstances.
-	server := grpcServer(store)
+	// Create the transport, wrapping the meshconn.Peer. Unlike the old
+	// single incomingc/outgoingc pair onto meshconn.Peer directly, each
+	// destination peer gets its own goroutine and bounded send queue, so one
+	// slow or unreachable peer can't stall Raft output to everyone else.
+	transport := NewTransport(peer, translateVia(router), ctrl, logger.With("component", "transport"))
+	defer transport.stop()
+	go func() {
+		for msg := range transport.Recv() {
+			incomingc <- msg
+		}
+	}()
+	go func() {
+		for msg := range outgoingc {
+			transport.Send(msg)
+		}
+	}()
+
+	// Create the admin server, which lets an operator reshape cluster
+	// membership at runtime via AddPeer/RemovePeer/ListPeers, independent of
+	// mesh-driven membership changes handled by the configurator above.
+	admin := newAdminServer(confchangec, adminentryc, logger.With("component", "admin"))
+
+	// Create the gRPC server, wrapping the store and the admin service. This
+	// is what gets returned to the user. But, we can shut it down in certain
+	// circumstances.
+	server := grpcServer(store, admin)
 	defer server.Stop()
 	out <- server
 
@@ -117,13 +232,13 @@ func grpcManager(
 		<-shrunkc
 		errc <- fmt.Errorf("the Raft cluster got too small")
 	}()
-	logger.Print(<-errc)
+	logger.Error("grpcManager exiting", "err", <-errc)
 }
 
 // NewDefaultServer is like NewServer, but we take care of creating a mesh.Router
 // and meshconn.Peer for you, using sane defaults. If you need more fine-grained
 // control, create these components yourself and use NewServer.
-func NewDefaultServer(minPeerCount int, logger *log.Logger) *wackygrpc.Server {
+func NewDefaultServer(minPeerCount int, mode Mode, storageDir string, logger Logger) *wackygrpc.Server {
 	var (
 		peerName = mustPeerName()
 		nickName = mustHostname()
@@ -132,6 +247,9 @@ func NewDefaultServer(minPeerCount int, logger *log.Logger) *wackygrpc.Server {
 		password = ""
 		channel  = "metcd"
 	)
+	// mesh.NewRouter and meshconn.NewPeer predate our structured Logger, so
+	// bridge it to the *log.Logger they expect.
+	stdlog := AsStdLogger(logger)
 	router := mesh.NewRouter(mesh.Config{
 		Host:               host,
 		Port:               port,
@@ -140,10 +258,10 @@ func NewDefaultServer(minPeerCount int, logger *log.Logger) *wackygrpc.Server {
 		ConnLimit:          64,
 		PeerDiscovery:      true,
 		TrustedSubnets:     []*net.IPNet{},
-	}, peerName, nickName, mesh.NullOverlay{}, logger)
+	}, peerName, nickName, mesh.NullOverlay{}, stdlog)
 
 	// Create a meshconn.Peer and connect it to a channel.
-	peer := meshconn.NewPeer(router.Ourself.Peer.Name, router.Ourself.UID, logger)
+	peer := meshconn.NewPeer(router.Ourself.Peer.Name, router.Ourself.UID, stdlog)
 	gossip := router.NewGossip(channel, peer)
 	peer.Register(gossip)
 
@@ -153,7 +271,7 @@ func NewDefaultServer(minPeerCount int, logger *log.Logger) *wackygrpc.Server {
 	// TODO(pb): determine if this is a super huge problem
 	router.Start()
 
-	return NewServer(router, peer, minPeerCount, logger)
+	return NewServer(router, peer, minPeerCount, mode, storageDir, logger)
 }
 
 func translateVia(router *mesh.Router) peerTranslator {
@@ -0,0 +1,145 @@
+package metcd
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/snap"
+	"github.com/coreos/etcd/wal"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// snapshotThreshold is the number of applied entries between snapshots. It
+// bounds both how much WAL a restarted peer has to replay and how large a
+// snapshot transferred to a new or lagging peer can get.
+const snapshotThreshold = 10000
+
+// Storage persists Raft entries, hard state, and periodic snapshots to
+// disk, so a restarted peer (or a restarted cluster) doesn't have to
+// re-replicate its entire history from scratch. It mirrors the WAL and
+// snapshot lifecycle etcd itself uses on top of the raft library.
+type Storage struct {
+	dir    string
+	wal    *wal.WAL
+	snap   *snap.Snapshotter
+	logger Logger
+
+	appliedIndex uint64
+}
+
+// openStorage opens (or initializes) WAL and snapshot directories under
+// dir, and replays the newest snapshot plus any WAL entries written after
+// it directly into mem: by the time openStorage returns, mem already
+// reflects that state, and the caller must not reapply it. hs and ents are
+// returned only so the caller can tell a restart from a fresh start (e.g.
+// to choose between raft.StartNode and raft.RestartNode); they are not for
+// re-feeding into mem.
+func openStorage(dir string, mem *raft.MemoryStorage, logger Logger) (s *Storage, hs raftpb.HardState, ents []raftpb.Entry, err error) {
+	snapDir := filepath.Join(dir, "snap")
+	walDir := filepath.Join(dir, "wal")
+
+	if err := os.MkdirAll(snapDir, 0o700); err != nil {
+		return nil, raftpb.HardState{}, nil, err
+	}
+	snapshotter := snap.New(snapDir)
+
+	var sn *raftpb.Snapshot
+	if existingSnap, err := snapshotter.Load(); err == nil {
+		sn = existingSnap
+	} else if err != snap.ErrNoSnapshot {
+		return nil, raftpb.HardState{}, nil, err
+	}
+
+	var w *wal.WAL
+	if !wal.Exist(walDir) {
+		w, err = wal.Create(walDir, nil)
+		if err != nil {
+			return nil, raftpb.HardState{}, nil, err
+		}
+	} else {
+		walsnap := walpb.Snapshot{}
+		if sn != nil {
+			walsnap.Index, walsnap.Term = sn.Metadata.Index, sn.Metadata.Term
+		}
+		w, err = wal.Open(walDir, walsnap)
+		if err != nil {
+			return nil, raftpb.HardState{}, nil, err
+		}
+		_, hs, ents, err = w.ReadAll()
+		if err != nil {
+			return nil, raftpb.HardState{}, nil, err
+		}
+	}
+
+	if sn != nil {
+		if err := mem.ApplySnapshot(*sn); err != nil {
+			return nil, raftpb.HardState{}, nil, err
+		}
+		s = &Storage{dir: dir, wal: w, snap: snapshotter, logger: logger, appliedIndex: sn.Metadata.Index}
+	} else {
+		s = &Storage{dir: dir, wal: w, snap: snapshotter, logger: logger}
+	}
+
+	if err := mem.SetHardState(hs); err != nil {
+		return nil, raftpb.HardState{}, nil, err
+	}
+	if err := mem.Append(ents); err != nil {
+		return nil, raftpb.HardState{}, nil, err
+	}
+	return s, hs, ents, nil
+}
+
+// Save appends newly-produced entries and the latest hard state to the WAL.
+// It must be called before those entries are applied to the state machine,
+// mirroring the etcd raft handler's WAL-before-apply ordering.
+func (s *Storage) Save(hs raftpb.HardState, ents []raftpb.Entry) error {
+	return s.wal.Save(hs, ents)
+}
+
+// MaybeSnapshot triggers a snapshot of the state machine once appliedIndex
+// has advanced snapshotThreshold entries past the last one, writes it via
+// the snapshotter, records it in the WAL, and compacts mem's log up to
+// snapshotThreshold entries before the snapshot index (or up to index 1 for
+// an early snapshot), so that many entries stay available behind it.
+// snapshot is a callback into the state machine producing its current
+// serialized state; it's only invoked when a snapshot is actually due.
+func (s *Storage) MaybeSnapshot(mem *raft.MemoryStorage, appliedIndex uint64, confState raftpb.ConfState, snapshot func() ([]byte, error)) error {
+	if appliedIndex-s.appliedIndex < snapshotThreshold {
+		return nil
+	}
+
+	data, err := snapshot()
+	if err != nil {
+		return err
+	}
+
+	sn, err := mem.CreateSnapshot(appliedIndex, &confState, data)
+	if err != nil {
+		return err
+	}
+	if err := s.snap.SaveSnap(sn); err != nil {
+		return err
+	}
+	if err := s.wal.SaveSnapshot(walpb.Snapshot{Index: sn.Metadata.Index, Term: sn.Metadata.Term}); err != nil {
+		return err
+	}
+
+	compactIndex := uint64(1)
+	if sn.Metadata.Index > snapshotThreshold {
+		compactIndex = sn.Metadata.Index - snapshotThreshold
+	}
+	if err := mem.Compact(compactIndex); err != nil && err != raft.ErrCompacted {
+		return err
+	}
+
+	s.appliedIndex = appliedIndex
+	s.logger.Info("storage: snapshotted", "index", sn.Metadata.Index, "compacted_to", compactIndex)
+	return nil
+}
+
+// Close releases the WAL file handle.
+func (s *Storage) Close() error {
+	return s.wal.Close()
+}
@@ -0,0 +1,247 @@
+package metcd
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/weaveworks/mesh"
+	"github.com/weaveworks/mesh/meshconn"
+)
+
+// Default tuning for per-peer send queues. These mirror the values
+// swarmkit's raft/transport package uses as sane defaults.
+const (
+	defaultSendQueueSize = 1024
+	defaultSendTimeout   = 10 * time.Second
+	defaultRetryInterval = time.Second
+)
+
+var (
+	transportMessagesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metcd",
+		Subsystem: "transport",
+		Name:      "messages_sent_total",
+		Help:      "Number of Raft messages sent per peer.",
+	}, []string{"to"})
+	transportMessagesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metcd",
+		Subsystem: "transport",
+		Name:      "messages_dropped_total",
+		Help:      "Number of Raft messages dropped because a peer's send queue was full.",
+	}, []string{"to"})
+	transportMessagesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metcd",
+		Subsystem: "transport",
+		Name:      "messages_failed_total",
+		Help:      "Number of Raft messages that failed to send to a peer.",
+	}, []string{"to"})
+)
+
+func init() {
+	prometheus.MustRegister(transportMessagesSent)
+	prometheus.MustRegister(transportMessagesDropped)
+	prometheus.MustRegister(transportMessagesFailed)
+}
+
+// Raft is what the transport needs from the Raft core, implemented by ctrl,
+// to report delivery problems and query membership status,
+// without the transport depending on ctrl directly.
+type Raft interface {
+	ReportUnreachable(id uint64)
+	ReportSnapshot(id uint64, status raft.SnapshotStatus)
+	IsIDRemoved(id uint64) bool
+	UpdateNode(id uint64, addr net.Addr)
+	NodeRemoved(id uint64)
+}
+
+// Transport replaces the single pair of incomingc/outgoingc channels that
+// newPacketTransport used to multiplex onto the meshconn.Peer. With a single
+// pair, one slow or unreachable peer could fill the shared outgoing channel
+// and stall Raft traffic to every other peer. Transport instead maintains a
+// goroutine and a bounded queue per destination, so peers are isolated from
+// each other's backpressure.
+type Transport struct {
+	peer       *meshconn.Peer
+	translator peerTranslator
+	raft       Raft
+	logger     Logger
+
+	sendTimeout   time.Duration
+	retryInterval time.Duration
+	queueSize     int
+
+	incomingc chan raftpb.Message
+
+	mtx   sync.Mutex
+	peers map[mesh.PeerUID]*transportPeer
+}
+
+// NewTransport creates a Transport wrapping peer. Incoming messages are
+// delivered on the returned Transport's Recv channel; use Send to enqueue
+// outgoing messages to a given peer.
+func NewTransport(peer *meshconn.Peer, translator peerTranslator, raft Raft, logger Logger) *Transport {
+	t := &Transport{
+		peer:          peer,
+		translator:    translator,
+		raft:          raft,
+		logger:        logger,
+		sendTimeout:   defaultSendTimeout,
+		retryInterval: defaultRetryInterval,
+		queueSize:     defaultSendQueueSize,
+		incomingc:     make(chan raftpb.Message),
+		peers:         map[mesh.PeerUID]*transportPeer{},
+	}
+	go t.recvLoop()
+	return t
+}
+
+// Recv returns the channel of messages received from other peers.
+func (t *Transport) Recv() <-chan raftpb.Message {
+	return t.incomingc
+}
+
+// Send enqueues msg for delivery to msg.To. It never blocks: if the
+// destination peer's queue is full, the message is dropped and counted,
+// exactly as swarmkit's transport drops rather than stalls the Raft loop.
+// Messages to a peer Raft has removed from the cluster are dropped outright,
+// and that peer's send goroutine and queue (if any) are torn down, rather
+// than kept alive sending to an ID that will never be valid again.
+func (t *Transport) Send(msg raftpb.Message) {
+	uid := mesh.PeerUID(msg.To)
+	if t.raft.IsIDRemoved(msg.To) {
+		t.removePeer(uid)
+		return
+	}
+
+	p := t.peerFor(uid)
+	select {
+	case p.outgoingc <- msg:
+	default:
+		transportMessagesDropped.WithLabelValues(p.label()).Inc()
+		t.raft.ReportUnreachable(msg.To)
+	}
+}
+
+// stop tears down every per-peer send goroutine. The receive loop is not
+// stopped: it runs until the meshconn.Peer's Recv returns an error.
+func (t *Transport) stop() {
+	t.mtx.Lock()
+	for _, p := range t.peers {
+		close(p.donec)
+	}
+	t.mtx.Unlock()
+}
+
+func (t *Transport) peerFor(uid mesh.PeerUID) *transportPeer {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	p, ok := t.peers[uid]
+	if !ok {
+		p = newTransportPeer(t, uid)
+		t.peers[uid] = p
+		go p.sendLoop()
+	}
+	return p
+}
+
+// removePeer tears down uid's send goroutine and queue, if one exists. It's
+// a no-op for an ID we never created a peer for.
+func (t *Transport) removePeer(uid mesh.PeerUID) {
+	t.mtx.Lock()
+	p, ok := t.peers[uid]
+	if ok {
+		delete(t.peers, uid)
+	}
+	t.mtx.Unlock()
+
+	if ok {
+		close(p.donec)
+	}
+}
+
+func (t *Transport) recvLoop() {
+	for {
+		msg, err := t.peer.Recv()
+		if err != nil {
+			t.logger.Error("transport: recv failed", "err", err)
+			return
+		}
+		t.incomingc <- msg
+	}
+}
+
+// transportPeer owns a single destination's send queue and goroutine, so a
+// slow or unreachable peer can never block traffic destined elsewhere.
+type transportPeer struct {
+	t   *Transport
+	uid mesh.PeerUID
+
+	outgoingc chan raftpb.Message
+	donec     chan struct{}
+}
+
+func newTransportPeer(t *Transport, uid mesh.PeerUID) *transportPeer {
+	return &transportPeer{
+		t:         t,
+		uid:       uid,
+		outgoingc: make(chan raftpb.Message, t.queueSize),
+		donec:     make(chan struct{}),
+	}
+}
+
+func (p *transportPeer) label() string {
+	name, err := p.t.translator(p.uid)
+	if err != nil {
+		return fmt.Sprintf("%x", uint64(p.uid))
+	}
+	return name.String()
+}
+
+func (p *transportPeer) sendLoop() {
+	for {
+		select {
+		case msg := <-p.outgoingc:
+			p.send(msg)
+		case <-p.donec:
+			return
+		}
+	}
+}
+
+func (p *transportPeer) send(msg raftpb.Message) {
+	name, err := p.t.translator(p.uid)
+	if err != nil {
+		p.fail(msg, err)
+		return
+	}
+
+	addr := meshconn.MeshAddr{PeerName: name, PeerUID: p.uid}
+	errc := make(chan error, 1)
+	go func() { errc <- p.t.peer.WriteTo(msg, addr) }()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			p.fail(msg, err)
+			return
+		}
+		transportMessagesSent.WithLabelValues(p.label()).Inc()
+	case <-time.After(p.t.sendTimeout):
+		p.fail(msg, fmt.Errorf("send timed out after %s", p.t.sendTimeout))
+	}
+}
+
+func (p *transportPeer) fail(msg raftpb.Message, err error) {
+	transportMessagesFailed.WithLabelValues(p.label()).Inc()
+	p.t.logger.Warn("transport: send failed", "to", msg.To, "err", err)
+	if msg.Type == raftpb.MsgSnap {
+		p.t.raft.ReportSnapshot(msg.To, raft.SnapshotFailure)
+	}
+	p.t.raft.ReportUnreachable(msg.To)
+}